@@ -0,0 +1,185 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// checkConstraints verifies that each concrete type supplied on the
+// command line satisfies the constraint (if any) declared on the
+// corresponding template parameter, eg that "string" satisfies
+// "comparable" in "template type Set(A comparable)", or that a caller
+// supplied type implements an interface declared in the template file
+// such as "Lesser" in "template type Sortable(A Lesser)".
+//
+// Fails with a diagnostic naming the offending argument rather than
+// letting an invalid instantiation through to the generated file.
+func (ti *templateInstantiation) checkConstraints(params []templateParam) {
+	haveConstraint := false
+	for _, p := range params {
+		if p.Constraint != "" {
+			haveConstraint = true
+		}
+	}
+	if !haveConstraint {
+		return
+	}
+
+	cfg := &packages.Config{
+		Mode: packages.NeedTypes | packages.NeedTypesInfo | packages.NeedSyntax | packages.NeedImports | packages.NeedDeps,
+		Dir:  ti.Dir,
+	}
+	pkgs, err := packages.Load(cfg, ti.Package, ".")
+	if err != nil {
+		fatalf("Failed to type check for constraint checking: %s", err)
+	}
+	if packages.PrintErrors(pkgs) > 0 {
+		fatalf("Errors type checking packages for constraint checking")
+	}
+
+	templatePkg, callerPkg := pkgs[0], pkgs[0]
+	if len(pkgs) > 1 {
+		callerPkg = pkgs[1]
+	}
+
+	for i, p := range params {
+		if p.Constraint == "" {
+			continue
+		}
+		argType := lookupType(callerPkg, ti.Args[i])
+		if argType == nil {
+			fatalf("Couldn't resolve type %q supplied for template parameter %s", ti.Args[i], p.Name)
+		}
+		if p.Constraint == "comparable" {
+			if !types.Comparable(argType) {
+				fatalf("Type %q supplied for template parameter %s doesn't satisfy comparable", ti.Args[i], p.Name)
+			}
+			continue
+		}
+		iface := lookupType(templatePkg, p.Constraint)
+		if iface == nil {
+			fatalf("Couldn't resolve constraint interface %q for template parameter %s", p.Constraint, p.Name)
+		}
+		ifaceType, ok := iface.Underlying().(*types.Interface)
+		if !ok {
+			fatalf("Constraint %q for template parameter %s isn't an interface", p.Constraint, p.Name)
+		}
+		// The interface is declared in terms of the stub type p.Name
+		// (eg "Less(A) bool"), so substitute the concrete argument for
+		// it before checking - otherwise a constraint that mentions the
+		// template parameter can never be satisfied
+		if paramType := lookupType(templatePkg, p.Name); paramType != nil {
+			ifaceType = substituteInterface(ifaceType, paramType, argType)
+		}
+		if !types.Implements(argType, ifaceType) && !types.Implements(types.NewPointer(argType), ifaceType) {
+			fatalf("Type %q supplied for template parameter %s doesn't implement constraint %q", ti.Args[i], p.Name, p.Constraint)
+		}
+	}
+}
+
+// substituteInterface returns a copy of iface with every occurrence of
+// from (the template parameter's stub type) in a method signature
+// replaced by to (the concrete argument type)
+func substituteInterface(iface *types.Interface, from, to types.Type) *types.Interface {
+	methods := make([]*types.Func, iface.NumMethods())
+	for i := 0; i < iface.NumMethods(); i++ {
+		m := iface.Method(i)
+		sig := substituteSignature(m.Type().(*types.Signature), from, to)
+		methods[i] = types.NewFunc(m.Pos(), m.Pkg(), m.Name(), sig)
+	}
+	embeddeds := make([]types.Type, iface.NumEmbeddeds())
+	for i := 0; i < iface.NumEmbeddeds(); i++ {
+		embeddeds[i] = iface.EmbeddedType(i)
+	}
+	result := types.NewInterfaceType(methods, embeddeds)
+	result.Complete()
+	return result
+}
+
+// substituteSignature returns a copy of sig with every occurrence of
+// from in its parameter and result types replaced by to
+func substituteSignature(sig *types.Signature, from, to types.Type) *types.Signature {
+	substTuple := func(tup *types.Tuple) *types.Tuple {
+		if tup == nil {
+			return nil
+		}
+		vars := make([]*types.Var, tup.Len())
+		for i := 0; i < tup.Len(); i++ {
+			v := tup.At(i)
+			vars[i] = types.NewVar(v.Pos(), v.Pkg(), v.Name(), substituteType(v.Type(), from, to))
+		}
+		return types.NewTuple(vars...)
+	}
+	return types.NewSignature(sig.Recv(), substTuple(sig.Params()), substTuple(sig.Results()), sig.Variadic())
+}
+
+// substituteType recursively replaces every occurrence of from with to
+// inside t, descending through the composite type constructors a
+// template parameter might legitimately appear in
+func substituteType(t types.Type, from, to types.Type) types.Type {
+	if types.Identical(t, from) {
+		return to
+	}
+	switch tt := t.(type) {
+	case *types.Pointer:
+		return types.NewPointer(substituteType(tt.Elem(), from, to))
+	case *types.Slice:
+		return types.NewSlice(substituteType(tt.Elem(), from, to))
+	case *types.Array:
+		return types.NewArray(substituteType(tt.Elem(), from, to), tt.Len())
+	case *types.Map:
+		return types.NewMap(substituteType(tt.Key(), from, to), substituteType(tt.Elem(), from, to))
+	case *types.Chan:
+		return types.NewChan(tt.Dir(), substituteType(tt.Elem(), from, to))
+	default:
+		return t
+	}
+}
+
+// lookupType resolves a type expression (as written on the command
+// line or in a constraint, eg "string", "[]int", "Foo" or "pkg.Foo")
+// to a types.Type in the scope of pkg, or nil if it can't be found.
+func lookupType(pkg *packages.Package, name string) types.Type {
+	expr, err := parser.ParseExpr(name)
+	if err != nil {
+		return nil
+	}
+
+	// A qualified identifier, eg "pkg.Foo" - look it up directly in the
+	// named import, since an isolated CheckExpr has no file scope to
+	// resolve the package qualifier against
+	if sel, ok := expr.(*ast.SelectorExpr); ok {
+		x, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return nil
+		}
+		for _, imp := range pkg.Imports {
+			if imp.Types != nil && imp.Types.Name() == x.Name {
+				if obj := imp.Types.Scope().Lookup(sel.Sel.Name); obj != nil {
+					if tn, ok := obj.(*types.TypeName); ok {
+						return tn.Type()
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	// Anything else - a bare identifier or a composite type expression
+	// like "[]int" or "map[string]int" - type check it against the
+	// package's scope (which chains up to the universe scope, so
+	// builtins resolve too)
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+	if err := types.CheckExpr(pkg.Fset, pkg.Types, token.NoPos, expr, info); err != nil {
+		return nil
+	}
+	tv, ok := info.Types[expr]
+	if !ok {
+		return nil
+	}
+	return tv.Type
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// isEgTemplateFile returns true if inputFile declares a "before" and
+// "after" function pair, ie it uses the example-based ("eg") template
+// flavour instead of a "template type Name(...)" declaration
+func isEgTemplateFile(inputFile string) bool {
+	_, f := parseFile(inputFile)
+	haveBefore, haveAfter := false, false
+	for _, decl := range f.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil {
+			switch fd.Name.Name {
+			case "before":
+				haveBefore = true
+			case "after":
+				haveAfter = true
+			}
+		}
+	}
+	return haveBefore && haveAfter
+}
+
+// parseEg parses an example-based template file and rewrites every
+// call to before(...) found in ti.Dir's package into the equivalent
+// after(...) expression or statement
+func (ti *templateInstantiation) parseEg(inputFile string) {
+	fset, f := parseFile(inputFile)
+
+	var before, after *ast.FuncDecl
+	for _, decl := range f.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Recv != nil {
+			continue
+		}
+		switch fd.Name.Name {
+		case "before":
+			before = fd
+		case "after":
+			after = fd
+		}
+	}
+	if before == nil || after == nil {
+		fatalf("Didn't find before/after function pair in %s", inputFile)
+	}
+
+	conf := types.Config{Importer: importer.Default(), Error: func(err error) { debugf("%s", err) }}
+	info := &types.Info{Defs: map[*ast.Ident]types.Object{}, Uses: map[*ast.Ident]types.Object{}}
+	// Best effort - before/after may reference caller-only names so the
+	// template file won't always type check standalone; use whatever
+	// signature information the AST gives us regardless
+	_, _ = conf.Check(f.Name.Name, fset, []*ast.File{f}, info)
+
+	if !signaturesMatch(before.Type, after.Type) {
+		fatalf("before and after in %s don't have matching signatures", inputFile)
+	}
+
+	var paramNames []string
+	var paramTypes []types.Type
+	for _, field := range before.Type.Params.List {
+		for _, name := range field.Names {
+			paramNames = append(paramNames, name.Name)
+			var t types.Type
+			if obj := info.Defs[name]; obj != nil {
+				t = obj.Type()
+			}
+			paramTypes = append(paramTypes, t)
+		}
+	}
+
+	// A pure-expression template (single return statement) is inlined
+	// as an expression wherever before(...) appears; anything else
+	// requires the call site to be a whole statement
+	var exprSrc string
+	if len(after.Body.List) == 1 {
+		if ret, ok := after.Body.List[0].(*ast.ReturnStmt); ok && len(ret.Results) == 1 {
+			exprSrc = formatNode(fset, ret.Results[0])
+		}
+	}
+	bodySrc := formatNode(fset, after.Body)
+
+	// Type check the caller's own package so we can tell a genuine call
+	// to before(...) (an identifier that doesn't resolve to anything -
+	// it's only ever understood by gotemplate) apart from an unrelated
+	// local function that also happens to be called "before", and so we
+	// can check argument types unify with before's parameters
+	cfg := &packages.Config{
+		Mode: packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedName | packages.NeedCompiledGoFiles,
+		Dir:  ti.Dir,
+	}
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		fatalf("Failed to load package at %s for rewriting: %s", ti.Dir, err)
+	}
+
+	matches := 0
+	for _, pkg := range pkgs {
+		for i, callerFile := range pkg.Syntax {
+			path := pkg.CompiledGoFiles[i]
+			matches += rewriteEgFile(path, pkg.Fset, callerFile, pkg.TypesInfo, paramNames, paramTypes, exprSrc, bodySrc)
+		}
+	}
+	logf("Rewrote %d call(s) to before() under %s", matches, ti.Dir)
+}
+
+// signaturesMatch reports whether before and after declare the same
+// number of parameters and results
+func signaturesMatch(before, after *ast.FuncType) bool {
+	if numFields(before.Params) != numFields(after.Params) {
+		return false
+	}
+	return numFields(before.Results) == numFields(after.Results)
+}
+
+func numFields(l *ast.FieldList) (n int) {
+	if l == nil {
+		return 0
+	}
+	for _, field := range l.List {
+		if len(field.Names) == 0 {
+			n++
+		} else {
+			n += len(field.Names)
+		}
+	}
+	return n
+}
+
+// formatNode renders node back to source text
+func formatNode(fset *token.FileSet, node ast.Node) string {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, node); err != nil {
+		fatalf("Failed to format node: %s", err)
+	}
+	return buf.String()
+}
+
+// egMatch records a span of the caller's original source (byte offsets
+// into its source text) to replace with the substituted after text
+type egMatch struct {
+	start, end int
+	text       string
+}
+
+// rewriteEgFile rewrites every call to before(...) found in f (already
+// parsed and type-checked as part of the caller's package), substituting
+// the bound arguments into the after template's text at each call site,
+// and returns the number of call sites rewritten.
+//
+// The substitution is done on source text, not by splicing AST nodes
+// together: the after template and the caller's argument expressions
+// come from different parses (different token.File regions, possibly
+// even different FileSets), and printing a node tree built out of
+// positions that don't belong together produces garbled line breaks.
+// Operating on text and only ever feeding a single coherent file
+// through format.Node at the end sidesteps that.
+func rewriteEgFile(path string, fset *token.FileSet, f *ast.File, info *types.Info, paramNames []string, paramTypes []types.Type, exprSrc, bodySrc string) int {
+	bind := func(call *ast.CallExpr) (map[string]string, bool) {
+		ident, ok := call.Fun.(*ast.Ident)
+		if !ok || ident.Name != "before" || len(call.Args) != len(paramNames) {
+			return nil, false
+		}
+		if obj := info.Uses[ident]; obj != nil {
+			// before resolves to a real declaration (the caller's own
+			// function, or something imported) - it isn't our macro
+			// name, so leave it alone
+			return nil, false
+		}
+		for i, argExpr := range call.Args {
+			if paramTypes[i] == nil {
+				continue
+			}
+			argType := info.TypeOf(argExpr)
+			if argType == nil {
+				continue
+			}
+			// An untyped constant arg (eg the literal 1 in before(1, 2))
+			// has no default type yet at this point, since nothing
+			// constrained it - compare its defaulted type, the same
+			// type it would settle on if actually assigned to a plain
+			// int variable, rather than rejecting it outright
+			if basic, ok := argType.(*types.Basic); ok && basic.Info()&types.IsUntyped != 0 {
+				argType = types.Default(argType)
+			}
+			if !types.AssignableTo(argType, paramTypes[i]) {
+				return nil, false
+			}
+		}
+		bindings := make(map[string]string, len(paramNames))
+		for i, name := range paramNames {
+			bindings[name] = formatNode(fset, call.Args[i])
+		}
+		return bindings, true
+	}
+
+	var matches []egMatch
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch node := n.(type) {
+		case *ast.ExprStmt:
+			if exprSrc != "" {
+				return true
+			}
+			call, ok := node.X.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if bindings, ok := bind(call); ok {
+				matches = append(matches, egMatch{
+					start: fset.Position(node.Pos()).Offset,
+					end:   fset.Position(node.End()).Offset,
+					text:  substituteText(bodySrc, bindings),
+				})
+				return false
+			}
+		case *ast.CallExpr:
+			if exprSrc == "" {
+				return true
+			}
+			if bindings, ok := bind(node); ok {
+				matches = append(matches, egMatch{
+					start: fset.Position(node.Pos()).Offset,
+					end:   fset.Position(node.End()).Offset,
+					text:  substituteText(exprSrc, bindings),
+				})
+				return false
+			}
+		}
+		return true
+	})
+
+	if len(matches) == 0 {
+		return 0
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].start < matches[j].start })
+
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		fatalf("Failed to read %s for rewriting: %s", path, err)
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	for _, m := range matches {
+		buf.Write(src[last:m.start])
+		buf.WriteString(m.text)
+		last = m.end
+	}
+	buf.Write(src[last:])
+
+	newFset := token.NewFileSet()
+	newFile, err := parser.ParseFile(newFset, path, buf.Bytes(), parser.ParseComments)
+	if err != nil {
+		fatalf("Failed to reparse rewritten %s: %s", path, err)
+	}
+	var out bytes.Buffer
+	if err := format.Node(&out, newFset, newFile); err != nil {
+		fatalf("Failed to format rewritten %s: %s", path, err)
+	}
+	if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+		fatalf("Failed to write rewritten %s: %s", path, err)
+	}
+	return len(matches)
+}
+
+// substituteText replaces every identifier token in src that's a key
+// of bindings with its bound text. Tokenizing (rather than a plain
+// string replace) keeps this from matching inside string/comment
+// literals or a longer identifier that merely contains a parameter
+// name as a substring.
+func substituteText(src string, bindings map[string]string) string {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+
+	var s scanner.Scanner
+	s.Init(file, []byte(src), nil, scanner.ScanComments)
+
+	var buf bytes.Buffer
+	last := 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok != token.IDENT {
+			continue
+		}
+		repl, ok := bindings[lit]
+		if !ok {
+			continue
+		}
+		offset := fset.Position(pos).Offset
+		buf.WriteString(src[last:offset])
+		buf.WriteString(repl)
+		last = offset + len(lit)
+	}
+	buf.WriteString(src[last:])
+	return buf.String()
+}
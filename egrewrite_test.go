@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const egTemplateSrc = `package egtmpl
+
+func before(a, b int) int {
+	return a + b
+}
+
+func after(a, b int) int {
+	return a*2 + b*2
+}
+`
+
+const egCallerSrc = `package caller
+
+func Sum() int {
+	return before(1, 2)
+}
+`
+
+// TestInstantiateEgTemplate instantiates an example-based (before/after)
+// template over a caller package and checks the call site was actually
+// rewritten to the equivalent "after" expression.
+func TestInstantiateEgTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tmplDir := filepath.Join(tmpDir, "egtmpl")
+	if err := os.Mkdir(tmplDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmplDir, "egtmpl.go"), []byte(egTemplateSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	callerDir := filepath.Join(tmpDir, "caller")
+	if err := os.Mkdir(callerDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	callerPath := filepath.Join(callerDir, "caller.go")
+	if err := ioutil.WriteFile(callerPath, []byte(egCallerSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// packages.Load shells out to "go list", which needs a module to
+	// anchor the caller package to
+	if err := ioutil.WriteFile(filepath.Join(callerDir, "go.mod"), []byte("module caller\n\ngo 1.21\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ti := &templateInstantiation{
+		Package: "./egtmpl",
+		Dir:     callerDir,
+	}
+	instantiatePackage("./egtmpl", tmpDir, []*templateInstantiation{ti})
+
+	out, err := ioutil.ReadFile(callerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(out), "before(") {
+		t.Errorf("caller.go still calls before(...) after rewriting:\n%s", out)
+	}
+	if !strings.Contains(string(out), "1*2 + 2*2") && !strings.Contains(string(out), "1*2+2*2") {
+		t.Errorf("caller.go wasn't rewritten to the expected after expression:\n%s", out)
+	}
+}
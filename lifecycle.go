@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// generatedHeader builds the comment written at the top of every
+// gotemplate_*.go file: a human readable "generated by gotemplate from
+// X on Y" line, and a machine-parseable "//gotemplate:instantiate"
+// comment encoding the exact package and instantiation so that
+// "gotemplate regenerate" can reproduce it without a separate manifest
+func (ti *templateInstantiation) generatedHeader() string {
+	spec := fmt.Sprintf("%s(%s)", ti.TemplateName, strings.Join(ti.Args, ","))
+	if ti.Name != ti.TemplateName {
+		spec = fmt.Sprintf("%s=%s", ti.Name, spec)
+	}
+	return fmt.Sprintf(
+		"// generated by gotemplate from %s on %s\n//gotemplate:instantiate %s %s\n\n",
+		ti.Package, time.Now().Format("2006-01-02"), ti.Package, spec,
+	)
+}
+
+// One discovered gotemplate_*.go file, and the instantiation recorded
+// in its header
+type generatedFileInfo struct {
+	Path    string
+	Dir     string
+	Package string
+	Spec    string // "Name(args)" or "Alias=Name(args)"
+}
+
+// "//gotemplate:instantiate pkg Name(args)"
+var matchGeneratedHeader = regexp.MustCompile(`^//gotemplate:instantiate\s+(\S+)\s+(.+?)\s*$`)
+
+// findGeneratedFiles walks dir looking for gotemplate_*.go files and
+// parses the "//gotemplate:instantiate" header out of each one it finds
+func findGeneratedFiles(dir string) (infos []generatedFileInfo) {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(filepath.Base(path), "gotemplate_") || !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		gi, ok := parseGeneratedHeader(path)
+		if !ok {
+			debugf("%s: no gotemplate header found, skipping", path)
+			return nil
+		}
+		infos = append(infos, gi)
+		return nil
+	})
+	if err != nil {
+		fatalf("Failed walking %s: %s", dir, err)
+	}
+	return
+}
+
+// parseGeneratedHeader reads the first few lines of path looking for
+// its "//gotemplate:instantiate" header
+func parseGeneratedHeader(path string) (generatedFileInfo, bool) {
+	in, err := os.Open(path)
+	if err != nil {
+		fatalf("Failed to open %s: %s", path, err)
+	}
+	defer in.Close()
+
+	scanner := bufio.NewScanner(in)
+	for i := 0; i < 10 && scanner.Scan(); i++ {
+		matches := matchGeneratedHeader.FindStringSubmatch(scanner.Text())
+		if matches == nil {
+			continue
+		}
+		return generatedFileInfo{
+			Path:    path,
+			Dir:     filepath.Dir(path),
+			Package: matches[1],
+			Spec:    matches[2],
+		}, true
+	}
+	return generatedFileInfo{}, false
+}
+
+// cmdList implements "gotemplate list [dir]" - reports every generated
+// file found under dir and the instantiation that produced it
+func cmdList(dir string) {
+	for _, gi := range findGeneratedFiles(dir) {
+		fmt.Printf("%s: %s %s\n", gi.Path, gi.Package, gi.Spec)
+	}
+}
+
+// cmdClean implements "gotemplate clean [dir]" - it removes generated
+// files whose source template package can no longer be found
+func cmdClean(dir string) {
+	for _, gi := range findGeneratedFiles(dir) {
+		if _, err := build.Default.Import(gi.Package, gi.Dir, build.ImportMode(0)); err != nil {
+			logf("Removing stale '%s' (package '%s' not found: %s)", gi.Path, gi.Package, err)
+			if err := os.Remove(gi.Path); err != nil {
+				fatalf("Failed to remove %s: %s", gi.Path, err)
+			}
+		}
+	}
+}
+
+// cmdRegenerate implements "gotemplate regenerate [dir]" - it re-runs
+// every instantiation recorded in a generated file's header, grouping
+// instantiations from the same directory and package together so
+// that shared helper code (see templatePackageAST) is only written once
+func cmdRegenerate(dir string) {
+	type key struct{ Dir, Package string }
+	groups := make(map[key][]*templateInstantiation)
+	var order []key
+	currentPackageName := findPackageName()
+
+	for _, gi := range findGeneratedFiles(dir) {
+		name, templateName, args := parseTemplateAndArgs(gi.Spec)
+		k := key{gi.Dir, gi.Package}
+		if _, found := groups[k]; !found {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], &templateInstantiation{
+			Package:      gi.Package,
+			TemplateName: templateName,
+			Name:         name,
+			Args:         args,
+			NewPackage:   currentPackageName,
+			Dir:          gi.Dir,
+		})
+	}
+	for _, k := range order {
+		instantiatePackage(k.Package, k.Dir, groups[k])
+	}
+}
@@ -2,24 +2,10 @@
 package main
 
 /*
-Are there any examples of wanting more than one type exported from the
-same package? Possibly for functional type utilities.
-
-Could import multiple types from the same package and the builder
-would do the right thing.
-
 Path generation for generated files could do with work - args may have
 spaces in, may have upper and lower case characters which will fold
 together on Windows.
 
-Detect dupliace template definitions so we don't write them multiple times
-
-write some test
-
-manage all the generated files - find them - delete stale ones, etg
-
-Put comment in generated file, generated by gotemplate from xyz on date?
-
 do replacements in comments too?
 */
 
@@ -40,12 +26,27 @@ import (
 	"strings"
 )
 
+// stringList implements flag.Value, collecting repeated occurrences of
+// a flag into a slice, eg -instantiate 'Set(string)' -instantiate 'Map(string,int)'
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 // Globals
 var (
 	// Flags
-	verbose = flag.Bool("v", false, "Verbose - print lots of stuff")
+	verbose      = flag.Bool("v", false, "Verbose - print lots of stuff")
+	instantiates stringList
 )
 
+func init() {
+	flag.Var(&instantiates, "instantiate", "Instantiate a template, eg 'Set(string)' - may be repeated instead of the parameter argument")
+}
+
 // Logging function
 var logf = log.Printf
 
@@ -73,14 +74,16 @@ func gofmtFile(fset *token.FileSet, f *ast.File) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Ouput the go formatted file
+// Ouput the go formatted file, with header prepended verbatim before
+// the package clause (eg a "generated by gotemplate" comment)
 //
 // Exits with a fatal error on error
-func outputFile(fset *token.FileSet, f *ast.File, path string) {
+func outputFile(fset *token.FileSet, f *ast.File, path string, header string) {
 	source, err := gofmtFile(fset, f)
 	if err != nil {
 		fatalf("Failed to output '%s': %s", path, err)
 	}
+	source = append([]byte(header), source...)
 	err = ioutil.WriteFile(path, source, 0777)
 	if err != nil {
 		fatalf("Failed to write '%s': %s", path, err)
@@ -104,11 +107,12 @@ func parseFile(path string) (*token.FileSet, *ast.File) {
 
 // Holds the desired templateInstantiation
 type templateInstantiation struct {
-	Package    string
-	Name       string
-	Args       []string
-	NewPackage string
-	Dir        string
+	Package      string
+	TemplateName string // name of the "template type" being instantiated, eg "Set"
+	Name         string // name of this instantiation, eg "StringSet" - defaults to TemplateName
+	Args         []string
+	NewPackage   string
+	Dir          string
 }
 
 // Parse the arguments string in Template(A, B, C)
@@ -132,196 +136,100 @@ func containsString(needle string, haystack []string) bool {
 	return false
 }
 
-// "template type Set(A)"
-var matchTemplateType = regexp.MustCompile(`^/[*/]\s+template\s+type\s+(\w+)\((.*?)\)\s*$`)
-
-// Parses the template file
-func (ti *templateInstantiation) parse(inputFile string) {
-	newIsPublic := ast.IsExported(ti.Name)
-
-	fset, f := parseFile(inputFile)
-
-	// Inspect the comments
-	templateName := ""
-	templateArgs := []string{}
-	for _, cg := range f.Comments {
-		for _, x := range cg.List {
-			matches := matchTemplateType.FindStringSubmatch(x.Text)
-			if matches != nil {
-				if templateName != "" {
-					fatalf("Found multiple template definitions in %s", inputFile)
-				}
-				templateName = matches[1]
-				templateArgs = parseArgs(matches[2])
-			}
-		}
-	}
-	if templateName == "" {
-		fatalf("Didn't find template definition in %s", inputFile)
-	}
-	if len(templateArgs) != len(ti.Args) {
-		fatalf("Wrong number of arguments - template is expecting %d but %d supplied", len(ti.Args), len(templateArgs))
-	}
-	debugf("templateName = %v, templateArgs = %v", templateName, templateArgs)
-	// debugf("Decls = %#v", f.Decls)
-	// Find names which need to be adjusted
-	namesToMangle := []string{}
-	newDecls := []ast.Decl{}
-	for _, Decl := range f.Decls {
-		remove := false
-		switch d := Decl.(type) {
-		case *ast.GenDecl:
-			// A general definition
-			switch d.Tok {
-			case token.IMPORT:
-				// Ignore imports
-			case token.CONST, token.VAR:
-				if len(d.Specs) != 1 {
-					log.Fatal("Unexpected specs on CONST/VAR")
-				}
-				v := d.Specs[0].(*ast.ValueSpec)
-				for _, name := range v.Names {
-					debugf("VAR or CONST %v", name.Name)
-					namesToMangle = append(namesToMangle, name.Name)
-				}
-			case token.TYPE:
-				if len(d.Specs) != 1 {
-					log.Fatal("Unexpected specs on TYPE")
-				}
-				t := d.Specs[0].(*ast.TypeSpec)
-				debugf("Type %v", t.Name.Name)
-				namesToMangle = append(namesToMangle, t.Name.Name)
-				// Remove type A if it is a template definition
-				remove = containsString(t.Name.Name, templateArgs)
-			default:
-				logf("Unknown type %s", d.Tok)
-			}
-			debugf("GenDecl = %#v", d)
-		case *ast.FuncDecl:
-			// A function definition
-			if d.Recv != nil {
-				// No receiver == method - ignore this function
-			} else {
-				//debugf("FuncDecl = %#v", d)
-				debugf("FuncDecl = %s", d.Name.Name)
-				namesToMangle = append(namesToMangle, d.Name.Name)
-				// Remove func A() if it is a template definition
-				remove = containsString(d.Name.Name, templateArgs)
-			}
-		default:
-			fatalf("Unknown Decl %#v", Decl)
-		}
-		if !remove {
-			newDecls = append(newDecls, Decl)
-		}
-	}
-	debugf("Names to mangle = %#v", namesToMangle)
-
-	// Remove the stub type definitions "type A int" from the package
-	f.Decls = newDecls
-
-	// Make the name mappings
-	mappings := make(map[string]string)
-
-	// Map the type definitions A -> string, B -> int
-	for i := range ti.Args {
-		mappings[templateArgs[i]] = ti.Args[i]
-	}
+// A single declared template parameter, eg "A" in "template type
+// Set(A)" or "A" with Constraint "comparable" in "template type
+// Set(A comparable)"
+type templateParam struct {
+	Name       string
+	Constraint string
+}
 
-	// FIXME factor to method
-	// FIXME put mappings as member
-	addMapping := func(name string) {
-		replacementName := ""
-		if !strings.Contains(name, templateName) {
-			// If name doesn't contain template name then just prefix it
-			replacementName = name + ti.Name
-			debugf("Top level definition '%s' doesn't contain template name '%s', using '%s'", name, templateName, replacementName)
-		} else {
-			replacementName = strings.Replace(name, templateName, ti.Name, 1)
-		}
-		// If new template name is not public then make sure
-		// the exported name is not public too
-		if !newIsPublic && ast.IsExported(replacementName) {
-			replacementName = strings.ToLower(replacementName[:1]) + replacementName[1:]
+// Parse the parameter list of a "template type" comment, eg "A
+// comparable, B Lesser" into templateParams
+//
+// FIXME use the Go parser for this?
+func parseTemplateParams(s string) (params []templateParam) {
+	for _, arg := range strings.Split(s, ",") {
+		arg = strings.TrimSpace(arg)
+		if arg == "" {
+			continue
 		}
-		mappings[name] = replacementName
-	}
-
-	found := false
-	for _, name := range namesToMangle {
-		if name == templateName {
-			found = true
-			addMapping(name)
-		} else if _, found := mappings[name]; !found {
-			addMapping(name)
+		fields := strings.Fields(arg)
+		p := templateParam{Name: fields[0]}
+		if len(fields) > 1 {
+			p.Constraint = fields[1]
 		}
-
-	}
-	if !found {
-		fatalf("No definition for template type '%s'", templateName)
+		params = append(params, p)
 	}
-	debugf("mappings = %#v", mappings)
-
-	newFile := f
-	for name, replacement := range mappings {
-		newFile = rewriteFile(fset, parseExpr(name, "pattern"), parseExpr(replacement, "replacement"), newFile)
-	}
-
-	// Change the package to the local package name
-	f.Name.Name = ti.NewPackage
-
-	// Output
-	outputFileName := "gotemplate_" + ti.Name + ".go"
-	outputFile(fset, newFile, outputFileName)
-	logf("Written '%s'", outputFileName)
+	return
 }
 
-// Instantiate the template package
-func (ti *templateInstantiation) instantiate() {
-	p, err := build.Default.Import(ti.Package, ti.Dir, build.ImportMode(0))
-	if err != nil {
-		fatalf("Import %s failed: %s", ti.Package, err)
-	}
-	//debugf("package = %#v", p)
-	debugf("Dir = %#v", p.Dir)
-	// FIXME CgoFiles ?
-	debugf("Go files = %#v", p.GoFiles)
-
-	if len(p.GoFiles) == 0 {
-		fatalf("No go files found for package '%s'", ti.Package)
-	}
-	// FIXME
-	if len(p.GoFiles) != 1 {
-		fatalf("Found more than one go file in '%s' - can only cope with 1 for the moment, sorry", ti.Package)
-	}
-
-	templateFilePath := path.Join(p.Dir, p.GoFiles[0])
-	ti.parse(templateFilePath)
-}
+// "template type Set(A)"
+var matchTemplateType = regexp.MustCompile(`^/[*/]\s+template\s+type\s+(\w+)\((.*?)\)\s*$`)
 
 // usage prints the syntax and exists
 func usage() {
 	BaseName := path.Base(os.Args[0])
 	fmt.Fprintf(os.Stderr,
-		"Syntax: %s [flags] package_name parameter\n\n"+
+		"Syntax: %s [flags] package_name 'Name(args), Name2(args2), ...'\n\n"+
+			"Or:     %s [flags] -instantiate 'Name(args)' [-instantiate 'Name2(args2)' ...] package_name\n\n"+
+			"Or:     %s list|clean|regenerate [dir]\n\n"+
+			"Name(args) may be written as Alias=Name(args) to instantiate the\n"+
+			"same template more than once under different names, eg\n"+
+			"'StringSet=Set(string), IntSet=Set(int)'\n\n"+
 			"Flags:\n\n",
-		BaseName)
+		BaseName, BaseName, BaseName)
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\n")
 	os.Exit(1)
 }
 
-var matchTemplateWithArgs = regexp.MustCompile(`^(\w+)\((.*?)\)\s*$`)
+// "TemplateName(A, B, C)" or "Alias=TemplateName(A, B, C)" - the alias
+// lets a template be instantiated more than once under different
+// names, eg "StringSet=Set(string), IntSet=Set(int)"
+var matchTemplateWithArgs = regexp.MustCompile(`^(?:(\w+)=)?(\w+)\((.*?)\)\s*$`)
 
-// Parse the arguments string Template(A, B, C)
+// Parse the arguments string "TemplateName(A, B, C)" or
+// "Alias=TemplateName(A, B, C)". name is the instantiation's own name
+// (the alias if one was given, otherwise templateName) and is what
+// generated files and mangled identifiers are named after;
+// templateName is which "template type" declaration to instantiate.
 //
 // FIXME use the Go parser for this?
-func parseTemplateAndArgs(s string) (name string, args []string) {
+func parseTemplateAndArgs(s string) (name, templateName string, args []string) {
 	matches := matchTemplateWithArgs.FindStringSubmatch(s)
 	if matches == nil {
 		fatalf("Bad template replacement string %q", s)
 	}
-	return matches[1], parseArgs(matches[2])
+	templateName = matches[2]
+	name = matches[1]
+	if name == "" {
+		name = templateName
+	}
+	return name, templateName, parseArgs(matches[3])
+}
+
+// splitInstantiations splits "Set(string), Map(string,int)" on top
+// level commas (ie not commas nested within the parameter parens) to
+// give the individual "Name(args)" specs
+func splitInstantiations(s string) (specs []string) {
+	depth := 0
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				specs = append(specs, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	specs = append(specs, strings.TrimSpace(s[start:]))
+	return
 }
 
 // findPackageName reads all the go packages in the curent directory
@@ -338,11 +246,45 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
-	if len(args) != 2 {
+
+	// list/clean/regenerate take zero or one trailing directory
+	// argument, which never contains '(' or ',' - unlike the normal
+	// "package_name 'Name(args), ...'" form, where the second argument
+	// is a template spec. That keeps a package literally named "list"
+	// (or "clean"/"regenerate") from being shadowed by the subcommand.
+	if len(instantiates) == 0 && (len(args) == 1 || (len(args) == 2 && !strings.ContainsAny(args[1], "(),"))) {
+		dir := "."
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		switch args[0] {
+		case "list":
+			cmdList(dir)
+			return
+		case "clean":
+			cmdClean(dir)
+			return
+		case "regenerate":
+			cmdRegenerate(dir)
+			return
+		}
+	}
+
+	var pkg string
+	var specs []string
+	switch {
+	case len(instantiates) > 0:
+		if len(args) != 1 {
+			fatalf("Need exactly 1 argument (the package) when using -instantiate")
+		}
+		pkg = args[0]
+		specs = instantiates
+	case len(args) == 2:
+		pkg = args[0]
+		specs = splitInstantiations(args[1])
+	default:
 		fatalf("Need 2 arguments, package and parameters")
 	}
-	pkg := args[0]
-	name, templateArgs := parseTemplateAndArgs(args[1])
 
 	currentPackageName := findPackageName()
 
@@ -350,14 +292,20 @@ func main() {
 	if err != nil {
 		log.Fatalf("Couldn't get wd: %v", err)
 	}
-	ti := &templateInstantiation{
-		Package:    pkg,
-		Name:       name,
-		Args:       templateArgs,
-		NewPackage: currentPackageName,
-		Dir:        cwd,
+
+	instantiations := make([]*templateInstantiation, len(specs))
+	for i, spec := range specs {
+		name, templateName, templateArgs := parseTemplateAndArgs(spec)
+		instantiations[i] = &templateInstantiation{
+			Package:      pkg,
+			TemplateName: templateName,
+			Name:         name,
+			Args:         templateArgs,
+			NewPackage:   currentPackageName,
+			Dir:          cwd,
+		}
+		logf("%s: substituting %q with %s(%s) as %s into package %s", os.Args[0], pkg, templateName, strings.Join(templateArgs, ","), name, currentPackageName)
 	}
-	logf("%s: substituting %q with %s(%s) into package %s", os.Args[0], ti.Package, ti.Name, strings.Join(ti.Args, ","), ti.NewPackage)
 
-	ti.instantiate()
+	instantiatePackage(pkg, cwd, instantiations)
 }
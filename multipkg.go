@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path"
+	"strings"
+)
+
+// A single "template type Name(...)" declaration found somewhere in a
+// template package
+type templateDef struct {
+	Name   string
+	Params []templateParam
+	File   string // which source file declared it
+}
+
+// templatePackageAST holds a merged view of every .go file making up a
+// template package: every template type it declares, and every
+// top-level Decl from every file. Helper decls - ones that aren't part
+// of any template type's stub definition or core implementation - are
+// shared between instantiations built from the same templatePackageAST
+// and are only written out to the first generated file that needs
+// them.
+type templatePackageAST struct {
+	Fset        *token.FileSet
+	Defs        map[string]templateDef
+	Decls       []ast.Decl
+	Comments    []*ast.CommentGroup
+	written     map[string]bool
+	outputNames map[string]bool
+}
+
+// parseTemplatePackage parses every file in goFiles (all in dir),
+// merges their declarations into one templatePackageAST and collects
+// every "template type Name(...)" comment, wherever in the package it
+// appears
+func parseTemplatePackage(dir string, goFiles []string) *templatePackageAST {
+	fset := token.NewFileSet()
+	tp := &templatePackageAST{
+		Fset:        fset,
+		Defs:        make(map[string]templateDef),
+		written:     make(map[string]bool),
+		outputNames: make(map[string]bool),
+	}
+	seenImports := make(map[string]bool)
+
+	for _, goFile := range goFiles {
+		filePath := path.Join(dir, goFile)
+		_, f := parseFileWithFset(fset, filePath)
+
+		for _, cg := range f.Comments {
+			for _, x := range cg.List {
+				matches := matchTemplateType.FindStringSubmatch(x.Text)
+				if matches == nil {
+					continue
+				}
+				name := matches[1]
+				if _, found := tp.Defs[name]; found {
+					fatalf("Found multiple template definitions for '%s' in %s", name, dir)
+				}
+				tp.Defs[name] = templateDef{
+					Name:   name,
+					Params: parseTemplateParams(matches[2]),
+					File:   filePath,
+				}
+			}
+		}
+
+		for _, decl := range f.Decls {
+			if imp, ok := decl.(*ast.GenDecl); ok && imp.Tok == token.IMPORT {
+				for _, spec := range imp.Specs {
+					importPath := spec.(*ast.ImportSpec).Path.Value
+					if seenImports[importPath] {
+						continue
+					}
+					seenImports[importPath] = true
+					tp.Decls = append(tp.Decls, decl)
+				}
+				continue
+			}
+			tp.Decls = append(tp.Decls, decl)
+		}
+		tp.Comments = append(tp.Comments, stripTemplateTypeComments(f.Comments)...)
+	}
+	if len(tp.Defs) == 0 {
+		fatalf("Didn't find any template definitions in %s", dir)
+	}
+	return tp
+}
+
+// stripTemplateTypeComments filters out "template type Name(...)"
+// comment groups, which describe the template package itself rather
+// than anything in a generated instantiation and so shouldn't be
+// copied verbatim into every gotemplate_*.go file
+func stripTemplateTypeComments(groups []*ast.CommentGroup) []*ast.CommentGroup {
+	var kept []*ast.CommentGroup
+	for _, cg := range groups {
+		isTemplateType := false
+		for _, c := range cg.List {
+			if matchTemplateType.MatchString(c.Text) {
+				isTemplateType = true
+				break
+			}
+		}
+		if !isTemplateType {
+			kept = append(kept, cg)
+		}
+	}
+	return kept
+}
+
+// parseFileWithFset is like parseFile but shares fset across every
+// file in a multi-file template package
+func parseFileWithFset(fset *token.FileSet, filePath string) (*token.FileSet, *ast.File) {
+	f, err := parser.ParseFile(fset, filePath, nil, parser.ParseComments)
+	if err != nil {
+		fatalf("Failed to parse file: %s", err)
+	}
+	return fset, f
+}
+
+// declName returns the name a top-level Decl introduces, or "" if it
+// doesn't introduce exactly one name (eg an import or a method)
+func declName(decl ast.Decl) string {
+	switch d := decl.(type) {
+	case *ast.GenDecl:
+		switch d.Tok {
+		case token.CONST, token.VAR:
+			if len(d.Specs) == 1 {
+				if v, ok := d.Specs[0].(*ast.ValueSpec); ok && len(v.Names) == 1 {
+					return v.Names[0].Name
+				}
+			}
+		case token.TYPE:
+			if len(d.Specs) == 1 {
+				if t, ok := d.Specs[0].(*ast.TypeSpec); ok {
+					return t.Name.Name
+				}
+			}
+		}
+	case *ast.FuncDecl:
+		if d.Recv == nil {
+			return d.Name.Name
+		}
+	}
+	return ""
+}
+
+// receiverTypeName returns the unwrapped (pointer stripped) name of a
+// method's receiver type, eg "List" for both "func (l List) ..." and
+// "func (l *List) ..."
+func receiverTypeName(fd *ast.FuncDecl) string {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return ""
+	}
+	t := fd.Recv.List[0].Type
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
+	}
+	if ident, ok := t.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// ownerName returns the top-level name a Decl belongs to for the
+// purpose of deciding which instantiation it should be emitted for:
+// for types, consts, vars and plain functions this is the name they
+// declare; for a method it's its receiver type's name, so that eg
+// "func (l *List) Push(...)" travels with the "List" template type
+// instead of being ignored (as a bare method receiver used to be) or
+// leaking into every other instantiation in the same package
+func ownerName(decl ast.Decl) (name string, isMethod bool) {
+	if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv != nil {
+		return receiverTypeName(fd), true
+	}
+	return declName(decl), false
+}
+
+// constructorOwner returns the template type name fd constructs, eg
+// "List" for "func NewList() *List", or "" if fd doesn't return (a
+// pointer to) one of the package's declared template types. A
+// constructor like this belongs with its template the same way a
+// method does - it shouldn't be dumped as a shared helper into
+// whichever instantiation happens to run first.
+func constructorOwner(fd *ast.FuncDecl, defs map[string]templateDef) string {
+	if fd.Recv != nil || fd.Type.Results == nil {
+		return ""
+	}
+	for _, field := range fd.Type.Results.List {
+		t := field.Type
+		if star, ok := t.(*ast.StarExpr); ok {
+			t = star.X
+		}
+		ident, ok := t.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		if _, ok := defs[ident.Name]; ok {
+			return ident.Name
+		}
+	}
+	return ""
+}
+
+// instantiate builds one gotemplate_<ti.Name>.go from def, stripping
+// out every template's stub definitions and every other template's
+// core implementation, and skipping helper decls already written by a
+// previous instantiation sharing this templatePackageAST
+func (tp *templatePackageAST) instantiate(ti *templateInstantiation, def templateDef) {
+	newIsPublic := ast.IsExported(ti.Name)
+
+	templateName := def.Name
+	templateArgs := make([]string, len(def.Params))
+	for i, p := range def.Params {
+		templateArgs[i] = p.Name
+	}
+	if len(templateArgs) != len(ti.Args) {
+		fatalf("Wrong number of arguments - template %s is expecting %d but %d supplied", templateName, len(templateArgs), len(ti.Args))
+	}
+	ti.checkConstraints(def.Params)
+
+	var stubNames []string
+	for _, otherDef := range tp.Defs {
+		for _, p := range otherDef.Params {
+			stubNames = append(stubNames, p.Name)
+		}
+	}
+
+	namesToMangle := []string{}
+	newDecls := []ast.Decl{}
+	foundCore := false
+	for _, decl := range tp.Decls {
+		name, isMethod := ownerName(decl)
+		if name == "" {
+			newDecls = append(newDecls, decl)
+			continue
+		}
+		if containsString(name, stubNames) {
+			// Stub type/func for a template parameter - never emitted
+			continue
+		}
+		if fd, ok := decl.(*ast.FuncDecl); ok && !isMethod {
+			if owner := constructorOwner(fd, tp.Defs); owner != "" {
+				if owner != templateName {
+					// A constructor for a different template type in
+					// this package - not part of this instantiation
+					continue
+				}
+				namesToMangle = append(namesToMangle, name)
+				newDecls = append(newDecls, decl)
+				continue
+			}
+		}
+		if _, isTemplate := tp.Defs[name]; isTemplate && name != templateName {
+			// Another template's core definition (or one of its methods)
+			// - not part of this instantiation
+			continue
+		}
+		if name == templateName {
+			if !isMethod {
+				namesToMangle = append(namesToMangle, name)
+				foundCore = true
+			}
+			newDecls = append(newDecls, decl)
+			continue
+		}
+		// A shared helper decl - only write it once across every
+		// instantiation sharing this templatePackageAST
+		if tp.written[name] {
+			continue
+		}
+		tp.written[name] = true
+		newDecls = append(newDecls, decl)
+	}
+	if !foundCore {
+		fatalf("No definition for template type '%s'", templateName)
+	}
+	debugf("Names to mangle = %#v", namesToMangle)
+
+	mappings := make(map[string]string)
+	for i := range ti.Args {
+		mappings[templateArgs[i]] = ti.Args[i]
+	}
+
+	addMapping := func(name string) {
+		replacementName := ""
+		if !strings.Contains(name, templateName) {
+			replacementName = name + ti.Name
+		} else {
+			replacementName = strings.Replace(name, templateName, ti.Name, 1)
+		}
+		if !newIsPublic && ast.IsExported(replacementName) {
+			replacementName = strings.ToLower(replacementName[:1]) + replacementName[1:]
+		}
+		mappings[name] = replacementName
+	}
+	for _, name := range namesToMangle {
+		addMapping(name)
+	}
+	debugf("mappings = %#v", mappings)
+
+	outputFileName := "gotemplate_" + ti.Name + ".go"
+	if tp.outputNames[outputFileName] {
+		fatalf("Two instantiations both want to write '%s' - give one an alias, eg 'Alias=%s(...)'", outputFileName, templateName)
+	}
+	tp.outputNames[outputFileName] = true
+
+	// newDecls and tp.Comments are shared with every other instantiation
+	// built from this templatePackageAST, so rewriteIdents can't rename
+	// identifiers on them in place - a second instantiation of the same
+	// template would find its stub names already renamed away by the
+	// first. Format and reparse into a fresh FileSet to get an unshared
+	// copy before mangling names.
+	f := &ast.File{Name: ast.NewIdent(ti.NewPackage), Decls: newDecls, Comments: tp.Comments}
+	fset, f := cloneFile(tp.Fset, f)
+	newFile := rewriteIdents(fset, f, mappings)
+
+	outputFile(fset, newFile, outputFileName, ti.generatedHeader())
+	logf("Written '%s'", outputFileName)
+}
+
+// cloneFile formats f (built from Decls/Comments shared with every
+// other instantiation of the same templatePackageAST) and reparses it
+// into a fresh FileSet, producing an unshared copy of the AST that's
+// safe for rewriteIdents to rename in place
+func cloneFile(fset *token.FileSet, f *ast.File) (*token.FileSet, *ast.File) {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		fatalf("Failed to format instantiation for cloning: %s", err)
+	}
+	newFset := token.NewFileSet()
+	newFile, err := parser.ParseFile(newFset, "", buf.Bytes(), parser.ParseComments)
+	if err != nil {
+		fatalf("Failed to reparse cloned instantiation: %s", err)
+	}
+	return newFset, newFile
+}
+
+// instantiatePackage finds pkg and carries out every requested
+// instantiation from it. It builds one merged AST view of the package
+// so that instantiations sharing helper code only get that code
+// written once, regardless of how many .go files or template type
+// declarations the package contains.
+func instantiatePackage(pkgPath string, dir string, instantiations []*templateInstantiation) {
+	p, err := build.Default.Import(pkgPath, dir, build.ImportMode(0))
+	if err != nil {
+		fatalf("Import %s failed: %s", pkgPath, err)
+	}
+	debugf("Dir = %#v", p.Dir)
+	debugf("Go files = %#v", p.GoFiles)
+
+	if len(p.GoFiles) == 0 {
+		fatalf("No go files found for package '%s'", pkgPath)
+	}
+
+	if len(p.GoFiles) == 1 {
+		templateFilePath := path.Join(p.Dir, p.GoFiles[0])
+		if isEgTemplateFile(templateFilePath) {
+			for _, ti := range instantiations {
+				ti.parseEg(templateFilePath)
+			}
+			return
+		}
+	}
+
+	tp := parseTemplatePackage(p.Dir, p.GoFiles)
+	for _, ti := range instantiations {
+		def, ok := tp.Defs[ti.TemplateName]
+		if !ok {
+			fatalf("No definition for template type '%s' in package '%s'", ti.TemplateName, pkgPath)
+		}
+		tp.instantiate(ti, def)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const listTemplateSrc = `package listtmpl
+
+// template type List(T)
+
+type T int
+
+type List []T
+
+func NewList() *List {
+	return &List{}
+}
+
+func (l *List) Push(v T) {
+	*l = append(*l, v)
+}
+
+func (l *List) Pop() T {
+	old := *l
+	n := len(old)
+	v := old[n-1]
+	*l = old[:n-1]
+	return v
+}
+
+func (l *List) Len() int {
+	return len(*l)
+}
+`
+
+// TestInstantiateListTemplate instantiates a List(T) template with
+// Push/Pop/Len methods on *List as List(int), then checks that the
+// generated file parses and type checks on its own.
+func TestInstantiateListTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmplDir := filepath.Join(tmpDir, "listtmpl")
+	if err := os.Mkdir(tmplDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmplDir, "list.go"), []byte(listTemplateSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := filepath.Join(tmpDir, "out")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(outDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// build.Default.Import rejects absolute import paths - resolve
+	// "./listtmpl" relative to tmpDir instead, same as gotemplate would
+	// see a relative package argument on the command line
+	ti := &templateInstantiation{
+		Package:      "./listtmpl",
+		TemplateName: "List",
+		Name:         "IntList",
+		Args:         []string{"int"},
+		NewPackage:   "out",
+		Dir:          outDir,
+	}
+	instantiatePackage("./listtmpl", tmpDir, []*templateInstantiation{ti})
+
+	outPath := filepath.Join(outDir, "gotemplate_IntList.go")
+	src, err := ioutil.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("generated file not written: %s", err)
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, outPath, src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("generated file doesn't parse: %s\n%s", err, src)
+	}
+
+	conf := types.Config{Importer: importer.Default()}
+	if _, err := conf.Check("out", fset, []*ast.File{f}, nil); err != nil {
+		t.Fatalf("generated file doesn't type check: %s\n%s", err, src)
+	}
+
+	for _, want := range []string{"IntList", "NewIntList", "Push", "Pop", "Len"} {
+		if !containsIdent(f, want) {
+			t.Errorf("generated file missing expected identifier %q\n%s", want, src)
+		}
+	}
+}
+
+func containsIdent(f *ast.File, name string) bool {
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Name == name {
+			found = true
+		}
+		return true
+	})
+	return found
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// rewriteIdents renames every identifier in f that go/types resolves
+// to one of our own top-level declarations (a key of mappings) to its
+// mapped replacement, using Defs/Uses scope information rather than
+// blind textual matching. This means a template type name that
+// happens to collide with a local variable, a struct field, or a name
+// pulled in by a dot import is left alone, and a qualified reference
+// like "pkg.Set" is never confused with a bare "Set".
+//
+// Identifiers go/types couldn't resolve (common for template files,
+// which reference the bare template parameter and helper names that
+// don't type check standalone) fall back to the previous behaviour of
+// renaming by bare name.
+func rewriteIdents(fset *token.FileSet, f *ast.File, mappings map[string]string) *ast.File {
+	pkg, info := typeCheckBestEffort(fset, f)
+
+	astutil.Apply(f, func(c *astutil.Cursor) bool {
+		id, ok := c.Node().(*ast.Ident)
+		if !ok {
+			return true
+		}
+		replacement, found := mappings[id.Name]
+		if !found {
+			return true
+		}
+		if c.Name() == "Sel" {
+			// The right hand side of a selector expression, eg "Set"
+			// in "pkg.Set" - only rewrite it if it resolves to one of
+			// our own top-level declarations, never an imported one
+			obj := info.Uses[id]
+			if obj == nil || pkg == nil || obj.Pkg() != pkg || obj.Parent() != pkg.Scope() {
+				return true
+			}
+		} else if obj := resolvedObject(info, id); obj != nil && pkg != nil {
+			// We managed to resolve this identifier - only rewrite it
+			// if it refers to our own top-level declaration, so a
+			// shadowing local variable or struct field of the same
+			// name is left untouched
+			if obj.Pkg() != pkg || obj.Parent() != pkg.Scope() {
+				return true
+			}
+		}
+		id.Name = replacement
+		return true
+	}, nil)
+
+	return f
+}
+
+// resolvedObject returns whatever types.Object go/types recorded for
+// id, preferring its Defs entry (the identifier is itself a
+// declaration) over its Uses entry (the identifier is a reference)
+func resolvedObject(info *types.Info, id *ast.Ident) types.Object {
+	if obj := info.Defs[id]; obj != nil {
+		return obj
+	}
+	return info.Uses[id]
+}
+
+// typeCheckBestEffort type-checks f on its own, returning whatever
+// package and Defs/Uses maps go/types managed to produce. Checking
+// errors are logged but otherwise ignored: f is the set of decls
+// already selected for this instantiation, with every stub
+// declaration for the template's own parameters (eg "type A int")
+// already stripped out, so any reference to a stub name - "Less(A)
+// bool" in a constraint interface carried through as a helper, say -
+// can never resolve here, and rewriteIdents falls back to renaming
+// that identifier by bare name instead of via scope. The guard above
+// it is real and does engage for everything else: locally shadowed
+// names, struct fields, and qualified "pkg.Set" references are all
+// correctly left alone, since those members type check fine within f.
+func typeCheckBestEffort(fset *token.FileSet, f *ast.File) (*types.Package, *types.Info) {
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{
+		Importer: importer.Default(),
+		Error:    func(err error) { debugf("type checking: %s", err) },
+	}
+	pkg, _ := conf.Check(f.Name.Name, fset, []*ast.File{f}, info)
+	return pkg, info
+}